@@ -0,0 +1,100 @@
+// Copyright 2014 beego Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// RedisConn is the minimal command surface RedisLocker needs. It is
+// satisfied by redigo's redis.Conn (github.com/garyburd/redigo/redis), the
+// client the bundled redis session provider is built on.
+type RedisConn interface {
+	Do(commandName string, args ...interface{}) (interface{}, error)
+	Close() error
+}
+
+// unlockScript deletes the lock key only if it still holds the token this
+// holder set, so a lock that expired and was re-acquired by someone else
+// is never dropped out from under them.
+const unlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// RedisLocker is a Locker backed by Redis, for coordinating SessionStart
+// across multiple beego processes sharing the redis session provider. It
+// acquires the lock with SET key token NX PX ttl and releases it with a
+// Lua compare-and-delete.
+type RedisLocker struct {
+	getConn func() RedisConn
+	prefix  string
+	ttl     time.Duration
+	retry   time.Duration
+}
+
+// NewRedisLocker creates a RedisLocker. getConn is called once per command
+// RedisLocker issues, e.g. wrapping a *redigo/redis.Pool's Get method, so
+// concurrent Lock calls for different sids never share a connection -
+// redis.Conn is documented as unsafe for concurrent use by multiple
+// goroutines. ttl bounds how long a lock is held before it expires on its
+// own, e.g. because the holder crashed; pass the ManagerConfig.LockTTL you
+// configured, converted from seconds to a time.Duration. ttl <= 0 defaults
+// to 30s.
+func NewRedisLocker(getConn func() RedisConn, ttl time.Duration) *RedisLocker {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	return &RedisLocker{getConn: getConn, prefix: "beegosessionlock:", ttl: ttl, retry: 50 * time.Millisecond}
+}
+
+// Lock implements Locker.
+func (l *RedisLocker) Lock(ctx context.Context, sid string) (func(), error) {
+	key := l.prefix + sid
+	token, err := randomLockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		conn := l.getConn()
+		reply, err := conn.Do("SET", key, token, "NX", "PX", l.ttl.Milliseconds())
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return func() {
+				c := l.getConn()
+				defer c.Close()
+				c.Do("EVAL", unlockScript, 1, key, token)
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.retry):
+		}
+	}
+}
+
+func randomLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
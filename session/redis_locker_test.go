@@ -0,0 +1,141 @@
+// Copyright 2014 beego Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRedisEntry is one key in fakeRedisBackend's store.
+type fakeRedisEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+// fakeRedisBackend is a tiny in-memory stand-in for the subset of Redis
+// RedisLocker depends on (SET key value NX PX ttl, and the compare-and-
+// delete EVAL it uses to unlock), shared by every fakeRedisConn checked
+// out from it so concurrent Lock calls actually contend with each other.
+type fakeRedisBackend struct {
+	mu    sync.Mutex
+	store map[string]fakeRedisEntry
+}
+
+func newFakeRedisBackend() *fakeRedisBackend {
+	return &fakeRedisBackend{store: make(map[string]fakeRedisEntry)}
+}
+
+// fakeRedisConn is a single checkout from a fakeRedisBackend. A fresh one
+// is handed out per call, mirroring how a real redigo pool is used.
+type fakeRedisConn struct {
+	backend *fakeRedisBackend
+	closed  bool
+}
+
+func (c *fakeRedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if c.closed {
+		return nil, fmt.Errorf("fakeRedisConn: Do called after Close")
+	}
+	b := c.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch commandName {
+	case "SET":
+		key, token := args[0].(string), args[1].(string)
+		ttlMs := args[4].(int64)
+		if entry, ok := b.store[key]; ok && time.Now().Before(entry.expiresAt) {
+			return nil, nil // NX: key already held and not yet expired
+		}
+		b.store[key] = fakeRedisEntry{value: token, expiresAt: time.Now().Add(time.Duration(ttlMs) * time.Millisecond)}
+		return "OK", nil
+	case "EVAL":
+		key, token := args[2].(string), args[3].(string)
+		entry, ok := b.store[key]
+		if !ok || time.Now().After(entry.expiresAt) || entry.value != token {
+			return int64(0), nil
+		}
+		delete(b.store, key)
+		return int64(1), nil
+	default:
+		return nil, fmt.Errorf("fakeRedisConn: unsupported command %q", commandName)
+	}
+}
+
+func (c *fakeRedisConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRedisLockerSerializesPerSid(t *testing.T) {
+	backend := newFakeRedisBackend()
+	locker := NewRedisLocker(func() RedisConn { return &fakeRedisConn{backend: backend} }, time.Second)
+
+	const holders = 10
+	var active, sawConcurrent int32
+	var wg sync.WaitGroup
+	for i := 0; i < holders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locker.Lock(context.Background(), "shared-sid")
+			if err != nil {
+				t.Errorf("Lock() error = %v", err)
+				return
+			}
+			if atomic.AddInt32(&active, 1) != 1 {
+				atomic.StoreInt32(&sawConcurrent, 1)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&sawConcurrent) != 0 {
+		t.Error("RedisLocker allowed concurrent holders of the same sid")
+	}
+	backend.mu.Lock()
+	_, exists := backend.store["beegosessionlock:shared-sid"]
+	backend.mu.Unlock()
+	if exists {
+		t.Error("lock key still present after every holder released it")
+	}
+}
+
+// TestRedisLockerExpiresStaleLock checks that a lock whose holder never
+// releases it (e.g. it crashed) still lets a new waiter in once its PX
+// TTL elapses, instead of wedging the sid forever.
+func TestRedisLockerExpiresStaleLock(t *testing.T) {
+	backend := newFakeRedisBackend()
+	locker := NewRedisLocker(func() RedisConn { return &fakeRedisConn{backend: backend} }, 20*time.Millisecond)
+
+	if _, err := locker.Lock(context.Background(), "sid"); err != nil {
+		t.Fatalf("first Lock() error = %v", err)
+	}
+	// The first holder is never unlocked, simulating a crash.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := locker.Lock(ctx, "sid"); err != nil {
+		t.Fatalf("second Lock() after TTL expiry error = %v", err)
+	}
+}
@@ -28,6 +28,9 @@
 package session
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -43,6 +46,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -68,6 +72,79 @@ type Provider interface {
 	SessionGC()
 }
 
+// ContextProvider is implemented by providers that can honor ctx's
+// deadline/cancellation while reading, destroying, or garbage-collecting
+// sessions, e.g. the redis and mysql drivers. A plain Provider is adapted
+// automatically by contextProviderAdapter, so existing providers keep
+// compiling unchanged while they grow context-aware methods.
+type ContextProvider interface {
+	Provider
+	SessionReadContext(ctx context.Context, sid string) (Store, error)
+	SessionDestroyContext(ctx context.Context, sid string) error
+	SessionGCContext(ctx context.Context)
+}
+
+// contextProviderAdapter adapts a Provider with no context-aware methods
+// to ContextProvider by ignoring ctx and calling through to the plain
+// methods.
+type contextProviderAdapter struct {
+	Provider
+}
+
+func (a contextProviderAdapter) SessionReadContext(ctx context.Context, sid string) (Store, error) {
+	return a.Provider.SessionRead(sid)
+}
+
+func (a contextProviderAdapter) SessionDestroyContext(ctx context.Context, sid string) error {
+	return a.Provider.SessionDestroy(sid)
+}
+
+func (a contextProviderAdapter) SessionGCContext(ctx context.Context) {
+	a.Provider.SessionGC()
+}
+
+// asContextProvider returns p as a ContextProvider, wrapping it in
+// contextProviderAdapter when p doesn't already implement the
+// context-aware methods itself.
+func asContextProvider(p Provider) ContextProvider {
+	if cp, ok := p.(ContextProvider); ok {
+		return cp
+	}
+	return contextProviderAdapter{p}
+}
+
+// TimestampedStore is implemented by Store implementations that track when
+// a session was created and last accessed, which SessionStartContext needs
+// to enforce ManagerConfig.IdleTimeout, AbsoluteTimeout and
+// RenewalInterval. A plain Store is adapted automatically by
+// timestampedStoreAdapter (reporting the zero Time, which disables
+// enforcement), so existing providers keep compiling until they grow
+// timestamp tracking.
+type TimestampedStore interface {
+	Store
+	// Created returns when the session currently identified by this
+	// Store's sid was created.
+	Created() time.Time
+	// LastAccessed returns when the session was last read or saved.
+	LastAccessed() time.Time
+}
+
+type timestampedStoreAdapter struct {
+	Store
+}
+
+func (timestampedStoreAdapter) Created() time.Time      { return time.Time{} }
+func (timestampedStoreAdapter) LastAccessed() time.Time { return time.Time{} }
+
+// asTimestampedStore returns s as a TimestampedStore, wrapping it in
+// timestampedStoreAdapter when s doesn't already track timestamps itself.
+func asTimestampedStore(s Store) TimestampedStore {
+	if ts, ok := s.(TimestampedStore); ok {
+		return ts
+	}
+	return timestampedStoreAdapter{s}
+}
+
 var provides = make(map[string]Provider)
 
 // SLogger a helpful variable to log information about session
@@ -86,26 +163,301 @@ func Register(name string, provide Provider) {
 	provides[name] = provide
 }
 
+var signers = make(map[string]func(secrets []string) Signer)
+
+// RegisterSigner makes a Signer factory available by the provided name for
+// ManagerConfig.SignerName. If RegisterSigner is called twice with the same
+// name or if factory is nil, it panics.
+func RegisterSigner(name string, factory func(secrets []string) Signer) {
+	if factory == nil {
+		panic("session: RegisterSigner factory is nil")
+	}
+	if _, dup := signers[name]; dup {
+		panic("session: RegisterSigner called twice for signer " + name)
+	}
+	signers[name] = factory
+}
+
+func init() {
+	RegisterSigner("hmac", func(secrets []string) Signer {
+		return NewRotatingHMACSigner(secrets)
+	})
+}
+
+// Signer signs and verifies the session id carried in a cookie.
+// Implementations must be safe for concurrent use.
+type Signer interface {
+	// Sign returns the signed representation of sid.
+	Sign(sid string) string
+	// Unsign verifies signed and returns the original sid.
+	// It returns an error when the signature does not verify.
+	Unsign(signed string) (string, error)
+}
+
+// Encryptor encrypts and decrypts the session payload before it is written
+// to a cookie, so a provider such as cookie can carry confidential data.
+type Encryptor interface {
+	Encrypt(plain []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// RotatingHMACSigner is the default Signer. New cookies are always signed
+// with the first secret; verification tries every secret in order, so
+// operators can rotate ManagerConfig.Secret / Secrets without invalidating
+// sessions that were signed under the previous key.
+type RotatingHMACSigner struct {
+	secrets []string
+}
+
+// NewRotatingHMACSigner creates a RotatingHMACSigner backed by secrets.
+// secrets should be ordered newest first; the first entry is used to sign,
+// every entry is tried when verifying.
+func NewRotatingHMACSigner(secrets []string) *RotatingHMACSigner {
+	return &RotatingHMACSigner{secrets: secrets}
+}
+
+// Sign implements Signer.
+func (s *RotatingHMACSigner) Sign(sid string) string {
+	var secret string
+	if len(s.secrets) > 0 {
+		secret = s.secrets[0]
+	}
+	return "s:" + sid + "." + hashSessionID(sid, secret)
+}
+
+// Unsign implements Signer.
+func (s *RotatingHMACSigner) Unsign(signed string) (string, error) {
+	dotIndex := strings.LastIndex(signed, ".")
+	if dotIndex < 2 || dotIndex >= len(signed)-1 {
+		return "", errors.New("session: malformed signed session id")
+	}
+	sid := signed[2:dotIndex]
+	hash := signed[dotIndex+1:]
+
+	secrets := s.secrets
+	if len(secrets) == 0 {
+		secrets = []string{""}
+	}
+	for _, secret := range secrets {
+		if hashSessionID(sid, secret) == hash {
+			return sid, nil
+		}
+	}
+	return "", errors.New("session: failed to unsign session id")
+}
+
+// Locker serializes access to a single session id, so concurrent requests
+// sharing a sid (AJAX bursts, prefetch) don't race between the Manager's
+// read and the eventual SessionRelease write-back.
+type Locker interface {
+	// Lock blocks until sid is locked, ctx is done, or a Locker-specific
+	// timeout elapses, and returns a function that releases it.
+	Lock(ctx context.Context, sid string) (unlock func(), err error)
+}
+
+// MutexLocker is the default Locker. It hands out one *sync.Mutex per sid,
+// reference-counted so the entry is dropped once nothing holds or is
+// waiting on it, and is only effective within a single process, which is
+// sufficient for the memory and file providers.
+type MutexLocker struct {
+	mu    sync.Mutex
+	locks map[string]*mutexEntry
+}
+
+// mutexEntry is a per-sid mutex plus the number of Lock calls currently
+// holding or waiting on it, so MutexLocker knows when it's safe to evict.
+type mutexEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// NewMutexLocker creates a MutexLocker.
+func NewMutexLocker() *MutexLocker {
+	return &MutexLocker{locks: make(map[string]*mutexEntry)}
+}
+
+func (l *MutexLocker) acquire(sid string) *mutexEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.locks[sid]
+	if !ok {
+		e = &mutexEntry{}
+		l.locks[sid] = e
+	}
+	e.refs++
+	return e
+}
+
+func (l *MutexLocker) release(sid string, e *mutexEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.refs--
+	if e.refs == 0 {
+		delete(l.locks, sid)
+	}
+}
+
+// Lock implements Locker.
+func (l *MutexLocker) Lock(ctx context.Context, sid string) (func(), error) {
+	e := l.acquire(sid)
+	locked := make(chan struct{})
+	go func() {
+		e.mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return func() {
+			e.mu.Unlock()
+			l.release(sid, e)
+		}, nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			e.mu.Unlock()
+			l.release(sid, e)
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// AESGCMEncryptor is the built-in Encryptor. The key is derived from a
+// secret via SHA-256 so callers can reuse an existing passphrase-style
+// config value instead of managing a raw 32-byte key.
+type AESGCMEncryptor struct {
+	key [32]byte
+}
+
+// NewAESGCMEncryptor creates an AESGCMEncryptor from secret.
+func NewAESGCMEncryptor(secret string) *AESGCMEncryptor {
+	return &AESGCMEncryptor{key: sha256.Sum256([]byte(secret))}
+}
+
+// Encrypt implements Encryptor.
+func (e *AESGCMEncryptor) Encrypt(plain []byte) ([]byte, error) {
+	gcm, err := e.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Decrypt implements Encryptor.
+func (e *AESGCMEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	gcm, err := e.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("session: ciphertext too short")
+	}
+	nonce, data := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, data, nil)
+}
+
+func (e *AESGCMEncryptor) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(e.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 type ManagerConfig struct {
-	CookieName              string `json:"cookieName"`
-	EnableSetCookie         bool   `json:"enableSetCookie,omitempty"`
-	Secret                  string `json:"secret"`
-	Gclifetime              int64  `json:"gclifetime"`
-	Maxlifetime             int64  `json:"maxLifetime"`
-	Secure                  bool   `json:"secure"`
-	CookieLifeTime          int    `json:"cookieLifeTime"`
-	ProviderConfig          string `json:"providerConfig"`
-	Domain                  string `json:"domain"`
-	SessionIDLength         int64  `json:"sessionIDLength"`
-	EnableSidInHttpHeader   bool   `json:"enableSidInHttpHeader"`
-	SessionNameInHttpHeader string `json:"sessionNameInHttpHeader"`
-	EnableSidInUrlQuery     bool   `json:"enableSidInUrlQuery"`
+	CookieName              string   `json:"cookieName"`
+	EnableSetCookie         bool     `json:"enableSetCookie,omitempty"`
+	Secret                  string   `json:"secret"`
+	Secrets                 []string `json:"secrets,omitempty"`
+	SignerName              string   `json:"signerName,omitempty"`
+	EncryptionKey           string   `json:"encryptionKey,omitempty"`
+	Gclifetime              int64    `json:"gclifetime"`
+	Maxlifetime             int64    `json:"maxLifetime"`
+	Secure                  bool     `json:"secure"`
+	CookieLifeTime          int      `json:"cookieLifeTime"`
+	ProviderConfig          string   `json:"providerConfig"`
+	Domain                  string   `json:"domain"`
+	SessionIDLength         int64    `json:"sessionIDLength"`
+	EnableSidInHttpHeader   bool     `json:"enableSidInHttpHeader"`
+	SessionNameInHttpHeader string   `json:"sessionNameInHttpHeader"`
+	EnableSidInUrlQuery     bool     `json:"enableSidInUrlQuery"`
+	// SameSite is one of "", "lax", "strict" or "none" (case-insensitive).
+	// "" leaves the attribute unset. "none" requires Secure.
+	SameSite string `json:"sameSite,omitempty"`
+	// CookiePrefix is one of "", "host" or "secure" (case-insensitive) and
+	// applies the matching `__Host-`/`__Secure-` prefix to CookieName.
+	CookiePrefix string `json:"cookiePrefix,omitempty"`
+	// Partitioned sets the cookie's Partitioned attribute (CHIPS), scoping
+	// it to the top-level site it was set from when embedded cross-site.
+	// Set via the raw Set-Cookie header rather than http.Cookie's (Go
+	// 1.23+) Partitioned field, so it works on older toolchains too.
+	Partitioned bool `json:"partitioned,omitempty"`
+	// LockTimeout bounds how long SessionStart waits to acquire the
+	// per-sid lock, in seconds. 0 means wait indefinitely.
+	LockTimeout int64 `json:"lockTimeout,omitempty"`
+	// LockTTL is the expiry, in seconds, a distributed Locker such as
+	// RedisLocker attaches to the lock it holds, so a holder that crashes
+	// without releasing doesn't wedge the session forever. NewManager does
+	// not read it; it takes effect only when passed to such a Locker, e.g.
+	// NewRedisLocker(getConn, time.Duration(LockTTL)*time.Second).
+	LockTTL int64 `json:"lockTTL,omitempty"`
+	// Locker serializes concurrent SessionStart calls for the same sid.
+	// Defaults to a per-process MutexLocker; set this to a distributed
+	// Locker such as RedisLocker to coordinate across processes.
+	Locker Locker `json:"-"`
+	// IdleTimeout destroys the session once it has gone this many seconds
+	// without being accessed. 0 disables idle expiry. Requires a
+	// TimestampedStore provider; a plain Store never expires this way.
+	IdleTimeout int64 `json:"idleTimeout,omitempty"`
+	// AbsoluteTimeout destroys the session this many seconds after it was
+	// created, regardless of activity. 0 disables absolute expiry.
+	// Requires a TimestampedStore provider.
+	AbsoluteTimeout int64 `json:"absoluteTimeout,omitempty"`
+	// RenewalInterval rotates the session id this many seconds after it
+	// was (last) created, the standard mitigation for session fixation.
+	// 0 disables automatic renewal. Requires a TimestampedStore provider.
+	RenewalInterval int64 `json:"renewalInterval,omitempty"`
 }
 
+// Cookie prefixes recognised by ManagerConfig.CookiePrefix.
+const (
+	CookiePrefixHost   = "host"
+	CookiePrefixSecure = "secure"
+)
+
 // Manager contains Provider and its configuration.
 type Manager struct {
-	provider Provider
-	config   *ManagerConfig
+	provider    Provider
+	ctxProvider ContextProvider
+	config      *ManagerConfig
+	signer      Signer
+	encryptor   Encryptor
+	// cookieName is config.CookieName with the __Host-/__Secure- prefix
+	// (if any) already applied.
+	cookieName string
+	sameSite   http.SameSite
+	locker     Locker
+}
+
+// parseSameSite maps a ManagerConfig.SameSite string to its http.SameSite
+// value.
+func parseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return http.SameSiteDefaultMode, fmt.Errorf("session: unknown SameSite %q", s)
+	}
 }
 
 // NewManager Create new Manager with provider name and json config string.
@@ -151,9 +503,67 @@ func NewManager(provideName string, cf *ManagerConfig) (*Manager, error) {
 		cf.SessionIDLength = 16
 	}
 
+	secrets := cf.Secrets
+	if len(secrets) == 0 && cf.Secret != "" {
+		secrets = []string{cf.Secret}
+	}
+
+	signerName := cf.SignerName
+	if signerName == "" {
+		signerName = "hmac"
+	}
+	newSigner, ok := signers[signerName]
+	if !ok {
+		return nil, fmt.Errorf("session: unknown signer %q (forgotten import?)", signerName)
+	}
+
+	var encryptor Encryptor
+	if cf.EncryptionKey != "" {
+		encryptor = NewAESGCMEncryptor(cf.EncryptionKey)
+	}
+
+	sameSite, err := parseSameSite(cf.SameSite)
+	if err != nil {
+		return nil, err
+	}
+	if sameSite == http.SameSiteNoneMode && !cf.Secure {
+		return nil, errors.New("session: SameSite=none cookies must set Secure")
+	}
+
+	cookieName := cf.CookieName
+	switch strings.ToLower(cf.CookiePrefix) {
+	case "":
+	case CookiePrefixHost:
+		if cf.Domain != "" {
+			return nil, errors.New("session: __Host- cookies must not set Domain")
+		}
+		if !cf.Secure {
+			return nil, errors.New("session: __Host- cookies must set Secure")
+		}
+		cookieName = "__Host-" + cookieName
+	case CookiePrefixSecure:
+		if !cf.Secure {
+			return nil, errors.New("session: __Secure- cookies must set Secure")
+		}
+		cookieName = "__Secure-" + cookieName
+	default:
+		return nil, fmt.Errorf("session: unknown cookie prefix %q", cf.CookiePrefix)
+	}
+
+	locker := cf.Locker
+	if locker == nil {
+		locker = NewMutexLocker()
+	}
+
 	return &Manager{
-		provider,
-		cf,
+		provider:    provider,
+		ctxProvider: asContextProvider(provider),
+		config:      cf,
+		signer:      newSigner(secrets),
+		encryptor:   encryptor,
+		cookieName:  cookieName,
+		sameSite:    sameSite,
+		locker:      locker,
 	}, nil
 }
 
@@ -165,7 +575,7 @@ func NewManager(provideName string, cf *ManagerConfig) (*Manager, error) {
 // sid is empty when need to generate a new session id
 // otherwise return an valid session id.
 func (manager *Manager) getSid(r *http.Request) (string, error) {
-	cookie, errs := r.Cookie(manager.config.CookieName)
+	cookie, errs := r.Cookie(manager.cookieName)
 	if errs != nil || cookie.Value == "" {
 		var sid string
 		if manager.config.EnableSidInUrlQuery {
@@ -174,7 +584,7 @@ func (manager *Manager) getSid(r *http.Request) (string, error) {
 				return "", errs
 			}
 
-			sid = r.FormValue(manager.config.CookieName)
+			sid = r.FormValue(manager.cookieName)
 		}
 
 		// if not found in Cookie / param, then read it from request headers
@@ -199,52 +609,307 @@ func (manager *Manager) getSid(r *http.Request) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return unsignSessionID(urlDecoded, manager.config.Secret), nil
+	sealed, err := manager.signer.Unsign(urlDecoded)
+	if err != nil {
+		SLogger.Println("session: failed to unsign session id:", err)
+		return "", nil
+	}
+	sid, err := manager.openSid(sealed)
+	if err != nil {
+		SLogger.Println("session: failed to decrypt session id:", err)
+		return "", nil
+	}
+	return sid, nil
+}
+
+// sealSid encrypts sid's session payload with manager.encryptor, if one is
+// configured, before it is signed and written to the cookie - this is what
+// lets a provider such as cookie, which carries the whole session inline,
+// keep that payload confidential. Without an encryptor it returns sid
+// unchanged.
+func (manager *Manager) sealSid(sid string) (string, error) {
+	if manager.encryptor == nil {
+		return sid, nil
+	}
+	ciphertext, err := manager.encryptor.Encrypt([]byte(sid))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ciphertext), nil
+}
+
+// openSid reverses sealSid, decrypting a value it produced back to the
+// original sid. Without an encryptor it returns sealed unchanged.
+func (manager *Manager) openSid(sealed string) (string, error) {
+	if manager.encryptor == nil {
+		return sealed, nil
+	}
+	ciphertext, err := hex.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	plain, err := manager.encryptor.Decrypt(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
 }
 
 // SessionStart generate or read the session id from http request.
 // if session id exists, return SessionStore with this id.
-func (manager *Manager) SessionStart(w http.ResponseWriter, r *http.Request) (session Store, err error) {
-	sid, errs := manager.getSid(r)
-	if errs != nil {
-		return nil, errs
+func (manager *Manager) SessionStart(w http.ResponseWriter, r *http.Request) (Store, error) {
+	_, store, err := manager.SessionStartContext(context.Background(), w, r)
+	return store, err
+}
+
+// SessionStartContext behaves like SessionStart, but passes ctx through to
+// the provider so Redis/MySQL-backed drivers can honor its deadline, and
+// returns a context in which the resulting Store has been stashed,
+// retrievable via FromContext.
+func (manager *Manager) SessionStartContext(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, Store, error) {
+	sid, err := manager.getSid(r)
+	if err != nil {
+		return ctx, nil, err
 	}
 
-	if sid != "" && manager.provider.SessionExist(sid) {
-		return manager.provider.SessionRead(sid)
+	isNew := !(sid != "" && manager.provider.SessionExist(sid))
+
+	if !isNew {
+		// Hold sid's lock across the whole check-then-act sequence below,
+		// so a renewal firing here can't race a concurrent request that's
+		// also reading/regenerating/destroying sid.
+		unlock, err := manager.lock(ctx, sid)
+		if err != nil {
+			return ctx, nil, err
+		}
+		switch action, err := manager.checkTimeouts(ctx, sid); {
+		case err != nil:
+			unlock()
+			return ctx, nil, err
+		case action == sessionExpired:
+			unlock()
+			isNew = true
+		case action == sessionRenew:
+			return manager.renew(ctx, w, r, sid, unlock)
+		default:
+			store, err := manager.ctxProvider.SessionReadContext(ctx, sid)
+			if err != nil {
+				unlock()
+				return ctx, nil, err
+			}
+			locked := &lockedStore{Store: store, unlock: unlock}
+			return context.WithValue(ctx, storeContextKey, locked), locked, nil
+		}
 	}
 
-	// Generate a new session
-	sid, errs = manager.sessionID()
-	if errs != nil {
-		return nil, errs
+	if isNew {
+		// Generate a new session
+		sid, err = manager.sessionID()
+		if err != nil {
+			return ctx, nil, err
+		}
 	}
 
-	session, err = manager.provider.SessionRead(sid)
+	store, err := manager.acquire(ctx, sid)
 	if err != nil {
-		return nil, errs
+		return ctx, nil, err
 	}
 
-	// To be able to share session and cookie with Stratus it needs to use the same algorithm for
-	// generating / parsing cookie string
-	// https://github.com/expressjs/session/blob/master/index.js#L635
-	// https://github.com/tj/node-cookie-signature
+	if isNew {
+		if err := manager.setSessionCookie(w, r, sid); err != nil {
+			if ls, ok := store.(*lockedStore); ok {
+				ls.once.Do(ls.unlock)
+			}
+			return ctx, nil, err
+		}
+	}
+
+	return context.WithValue(ctx, storeContextKey, store), store, nil
+}
+
+// timeoutAction is what checkTimeouts recommends SessionStartContext do
+// about sid.
+type timeoutAction int
+
+const (
+	sessionOK timeoutAction = iota
+	// sessionExpired means sid was destroyed and a new session must be
+	// started in its place.
+	sessionExpired
+	// sessionRenew means sid is still valid but due for id rotation.
+	sessionRenew
+)
+
+// checkTimeouts inspects sid's Created/LastAccessed timestamps (via
+// TimestampedStore) against IdleTimeout, AbsoluteTimeout and
+// RenewalInterval, destroying sid if either timeout has fired. It is a
+// no-op, always reporting sessionOK, unless at least one of those is
+// configured. Callers must hold sid's lock for the duration of this call
+// and of acting on its result, since it reads sid and may destroy it.
+func (manager *Manager) checkTimeouts(ctx context.Context, sid string) (timeoutAction, error) {
+	if manager.config.IdleTimeout == 0 && manager.config.AbsoluteTimeout == 0 && manager.config.RenewalInterval == 0 {
+		return sessionOK, nil
+	}
+
+	store, err := manager.ctxProvider.SessionReadContext(ctx, sid)
+	if err != nil {
+		return sessionOK, err
+	}
+	ts := asTimestampedStore(store)
+	now := time.Now()
+
+	if manager.config.AbsoluteTimeout > 0 && !ts.Created().IsZero() &&
+		now.Sub(ts.Created()) > time.Duration(manager.config.AbsoluteTimeout)*time.Second {
+		manager.ctxProvider.SessionDestroyContext(ctx, sid)
+		return sessionExpired, nil
+	}
+	if manager.config.IdleTimeout > 0 && !ts.LastAccessed().IsZero() &&
+		now.Sub(ts.LastAccessed()) > time.Duration(manager.config.IdleTimeout)*time.Second {
+		manager.ctxProvider.SessionDestroyContext(ctx, sid)
+		return sessionExpired, nil
+	}
+	if manager.config.RenewalInterval > 0 && !ts.Created().IsZero() &&
+		now.Sub(ts.Created()) >= time.Duration(manager.config.RenewalInterval)*time.Second {
+		return sessionRenew, nil
+	}
+	return sessionOK, nil
+}
+
+// acquire locks sid, reads its Store from the provider, and wraps it so
+// the lock is released on SessionRelease.
+func (manager *Manager) acquire(ctx context.Context, sid string) (Store, error) {
+	unlock, err := manager.lock(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	store, err := manager.ctxProvider.SessionReadContext(ctx, sid)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return &lockedStore{Store: store, unlock: unlock}, nil
+}
+
+// renew rotates oldsid to a freshly generated id, migrating the session
+// data via the provider's SessionRegenerate and writing the new cookie -
+// the same fixation-mitigation pattern MarkAuthenticated uses after login.
+// unlockOld releases a lock the caller holds on oldsid, taken before it
+// decided to call renew; renew holds it for the whole SessionRegenerate
+// call so no concurrent request can race it on oldsid, then releases it.
+func (manager *Manager) renew(ctx context.Context, w http.ResponseWriter, r *http.Request, oldsid string, unlockOld func()) (context.Context, Store, error) {
+	defer unlockOld()
+	sid, err := manager.sessionID()
+	if err != nil {
+		return ctx, nil, err
+	}
+	unlock, err := manager.lock(ctx, sid)
+	if err != nil {
+		return ctx, nil, err
+	}
+	raw, err := manager.provider.SessionRegenerate(oldsid, sid)
+	if err != nil {
+		unlock()
+		return ctx, nil, err
+	}
+	store := &lockedStore{Store: raw, unlock: unlock}
+	if err := manager.setSessionCookie(w, r, sid); err != nil {
+		store.once.Do(store.unlock)
+		return ctx, nil, err
+	}
+	return context.WithValue(ctx, storeContextKey, store), store, nil
+}
+
+// MarkAuthenticated forcibly rotates the id of the request's current
+// session, migrating its data to the new id and issuing the corresponding
+// cookie. Call it right after a successful login to defend against
+// session fixation. If the request carries no valid session, it is
+// equivalent to SessionStart.
+func (manager *Manager) MarkAuthenticated(w http.ResponseWriter, r *http.Request) (Store, error) {
+	sid, err := manager.getSid(r)
+	if err != nil {
+		return nil, err
+	}
+	if sid == "" || !manager.provider.SessionExist(sid) {
+		return manager.SessionStart(w, r)
+	}
+	ctx := r.Context()
+	unlock, err := manager.lock(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	_, store, err := manager.renew(ctx, w, r, sid, unlock)
+	return store, err
+}
+
+// lock acquires manager.locker for sid, honoring ManagerConfig.LockTimeout
+// when set.
+func (manager *Manager) lock(ctx context.Context, sid string) (func(), error) {
+	if manager.config.LockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(manager.config.LockTimeout)*time.Second)
+		defer cancel()
+	}
+	return manager.locker.Lock(ctx, sid)
+}
+
+// lockedStore wraps a Store so the per-sid lock acquired in
+// SessionStartContext is released exactly once, when SessionRelease runs.
+type lockedStore struct {
+	Store
+	unlock func()
+	once   sync.Once
+}
+
+// SessionRelease implements Store.
+func (s *lockedStore) SessionRelease(w http.ResponseWriter) {
+	s.Store.SessionRelease(w)
+	s.once.Do(s.unlock)
+}
+
+// setCookie writes cookie via w.Header(), appending the Partitioned
+// attribute (CHIPS) to the raw Set-Cookie header when partitioned is set.
+// http.Cookie grew a native Partitioned field in Go 1.23; appending it by
+// hand keeps this compiling against older toolchains, which beego as a
+// widely-embedded library still needs to support.
+func setCookie(w http.ResponseWriter, cookie *http.Cookie, partitioned bool) {
+	v := cookie.String()
+	if v == "" {
+		return
+	}
+	if partitioned {
+		v += "; Partitioned"
+	}
+	w.Header().Add("Set-Cookie", v)
+}
 
+// setSessionCookie writes the cookie (and, if configured, the request/
+// response header) that carries a freshly generated sid back to the
+// client.
+//
+// To be able to share session and cookie with Stratus it needs to use the same algorithm for
+// generating / parsing cookie string
+// https://github.com/expressjs/session/blob/master/index.js#L635
+// https://github.com/tj/node-cookie-signature
+func (manager *Manager) setSessionCookie(w http.ResponseWriter, r *http.Request, sid string) error {
+	sealed, err := manager.sealSid(sid)
+	if err != nil {
+		return err
+	}
 	cookie := &http.Cookie{
-		Name: manager.config.CookieName,
-		// Value:    url.QueryEscape(sid),
-		Value:    url.QueryEscape(signSessionID(sid, manager.config.Secret)),
+		Name:     manager.cookieName,
+		Value:    url.QueryEscape(manager.signer.Sign(sealed)),
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   manager.isSecure(r),
 		Domain:   manager.config.Domain,
+		SameSite: manager.sameSite,
 	}
 	if manager.config.CookieLifeTime > 0 {
 		cookie.MaxAge = manager.config.CookieLifeTime
 		cookie.Expires = time.Now().Add(time.Duration(manager.config.CookieLifeTime) * time.Second)
 	}
 	if manager.config.EnableSetCookie {
-		http.SetCookie(w, cookie)
+		setCookie(w, cookie, manager.config.Partitioned)
 	}
 	r.AddCookie(cookie)
 
@@ -252,27 +917,32 @@ func (manager *Manager) SessionStart(w http.ResponseWriter, r *http.Request) (se
 		r.Header.Set(manager.config.SessionNameInHttpHeader, sid)
 		w.Header().Set(manager.config.SessionNameInHttpHeader, sid)
 	}
-
-	return
+	return nil
 }
 
 // SessionDestroy Destroy session by its id in http request cookie.
 func (manager *Manager) SessionDestroy(w http.ResponseWriter, r *http.Request) {
+	manager.SessionDestroyContext(context.Background(), w, r)
+}
+
+// SessionDestroyContext behaves like SessionDestroy, but passes ctx through
+// to the provider so Redis/MySQL-backed drivers can honor its deadline.
+func (manager *Manager) SessionDestroyContext(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	if manager.config.EnableSidInHttpHeader {
 		r.Header.Del(manager.config.SessionNameInHttpHeader)
 		w.Header().Del(manager.config.SessionNameInHttpHeader)
 	}
 
-	cookie, err := r.Cookie(manager.config.CookieName)
+	cookie, err := r.Cookie(manager.cookieName)
 	if err != nil || cookie.Value == "" {
 		return
 	}
 
 	sid, _ := url.QueryUnescape(cookie.Value)
-	manager.provider.SessionDestroy(sid)
+	manager.ctxProvider.SessionDestroyContext(ctx, sid)
 	if manager.config.EnableSetCookie {
 		expiration := time.Now()
-		cookie = &http.Cookie{Name: manager.config.CookieName,
+		cookie = &http.Cookie{Name: manager.cookieName,
 			Path:     "/",
 			HttpOnly: true,
 			Expires:  expiration,
@@ -282,6 +952,67 @@ func (manager *Manager) SessionDestroy(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type contextKey int
+
+// storeContextKey is the key under which SessionStartContext and
+// Middleware stash the active Store in a request context.
+const storeContextKey contextKey = 0
+
+// FromContext returns the Store stashed in ctx by SessionStartContext or
+// Middleware, if any.
+func FromContext(ctx context.Context) (Store, bool) {
+	store, ok := ctx.Value(storeContextKey).(Store)
+	return store, ok
+}
+
+// Middleware returns an http.Handler that starts a session for every
+// request via SessionStartContext, exposes the resulting Store through the
+// request context (see FromContext), and calls SessionRelease on it -
+// either the first time next writes to the response, or after next
+// returns, whichever happens first.
+func (manager *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, store, err := manager.SessionStartContext(r.Context(), w, r)
+		if err != nil {
+			SLogger.Println("session: middleware failed to start session:", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &releasingResponseWriter{ResponseWriter: w, store: store}
+		defer rw.release()
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// releasingResponseWriter calls Store.SessionRelease the first time the
+// wrapped handler writes to the response, so providers that write their
+// own headers/cookies during release (e.g. the cookie provider) run
+// before the handler's headers are flushed.
+type releasingResponseWriter struct {
+	http.ResponseWriter
+	store    Store
+	released bool
+}
+
+func (w *releasingResponseWriter) release() {
+	if w.released {
+		return
+	}
+	w.released = true
+	w.store.SessionRelease(w.ResponseWriter)
+}
+
+func (w *releasingResponseWriter) WriteHeader(code int) {
+	w.release()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *releasingResponseWriter) Write(b []byte) (int, error) {
+	w.release()
+	return w.ResponseWriter.Write(b)
+}
+
 // GetSessionStore Get SessionStore by its id.
 func (manager *Manager) GetSessionStore(sid string) (sessions Store, err error) {
 	sessions, err = manager.provider.SessionRead(sid)
@@ -301,16 +1032,17 @@ func (manager *Manager) SessionRegenerateID(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		return
 	}
-	cookie, err := r.Cookie(manager.config.CookieName)
+	cookie, err := r.Cookie(manager.cookieName)
 	if err != nil || cookie.Value == "" {
 		//delete old cookie
 		session, _ = manager.provider.SessionRead(sid)
-		cookie = &http.Cookie{Name: manager.config.CookieName,
+		cookie = &http.Cookie{Name: manager.cookieName,
 			Value:    url.QueryEscape(sid),
 			Path:     "/",
 			HttpOnly: true,
 			Secure:   manager.isSecure(r),
 			Domain:   manager.config.Domain,
+			SameSite: manager.sameSite,
 		}
 	} else {
 		oldsid, _ := url.QueryUnescape(cookie.Value)
@@ -318,13 +1050,14 @@ func (manager *Manager) SessionRegenerateID(w http.ResponseWriter, r *http.Reque
 		cookie.Value = url.QueryEscape(sid)
 		cookie.HttpOnly = true
 		cookie.Path = "/"
+		cookie.SameSite = manager.sameSite
 	}
 	if manager.config.CookieLifeTime > 0 {
 		cookie.MaxAge = manager.config.CookieLifeTime
 		cookie.Expires = time.Now().Add(time.Duration(manager.config.CookieLifeTime) * time.Second)
 	}
 	if manager.config.EnableSetCookie {
-		http.SetCookie(w, cookie)
+		setCookie(w, cookie, manager.config.Partitioned)
 	}
 	r.AddCookie(cookie)
 
@@ -381,35 +1114,6 @@ func NewSessionLog(out io.Writer) *Log {
 	return sl
 }
 
-// sign session ID for set cookie
-// https://github.com/expressjs/session/blob/master/index.js#L634
-func signSessionID(sid, secret string) string {
-	return "s:" + sid + "." + hashSessionID(sid, secret)
-}
-
-// This actually verifies the session ID from cookie
-// signed session id from cookie looks like:
-// s:FcLdqhSWA29y4JhyiHn4rhJ3bZ_GLuTt.s/INCWYNqDc4ziAx+t+La9+QSuGjnTglvJIhtmMXuUs
-// https://github.com/tj/node-cookie-signature/blob/master/index.js#L36
-func unsignSessionID(signedSid, secret string) string {
-	dotIndex := strings.LastIndex(signedSid, ".")
-	sid := signedSid[2:dotIndex]
-	hash := signedSid[dotIndex+1:]
-
-	fmt.Println("sid", sid)
-	fmt.Println("secret", secret)
-	fmt.Println("hash", hash)
-	fmt.Println("calculated:", hashSessionID(sid, secret))
-
-	if hashSessionID(sid, secret) == hash {
-		fmt.Println("session unsigned")
-		return sid
-	} else {
-		fmt.Println("failed to unsign session")
-		return ""
-	}
-}
-
 // generate hash from session ID
 // https://github.com/tj/node-cookie-signature/blob/master/index.js#L16
 func hashSessionID(sid, secret string) string {
@@ -0,0 +1,506 @@
+// Copyright 2014 beego Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRotatingHMACSignerSignUnsign(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []string
+	}{
+		{"single secret", []string{"s1"}},
+		{"multiple secrets, newest first", []string{"new", "old"}},
+		{"no secret", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewRotatingHMACSigner(tt.secrets)
+			signed := s.Sign("abc123")
+			got, err := s.Unsign(signed)
+			if err != nil {
+				t.Fatalf("Unsign() error = %v", err)
+			}
+			if got != "abc123" {
+				t.Errorf("Unsign() = %q, want %q", got, "abc123")
+			}
+		})
+	}
+}
+
+// TestRotatingHMACSignerRotation covers the scenario the type exists for:
+// an operator prepends a new secret ahead of the old one, and cookies
+// signed under the old secret must keep verifying until they expire.
+func TestRotatingHMACSignerRotation(t *testing.T) {
+	oldSigner := NewRotatingHMACSigner([]string{"old-secret"})
+	signed := oldSigner.Sign("sid-1")
+
+	rotatedSigner := NewRotatingHMACSigner([]string{"new-secret", "old-secret"})
+	got, err := rotatedSigner.Unsign(signed)
+	if err != nil {
+		t.Fatalf("Unsign() after rotation error = %v", err)
+	}
+	if got != "sid-1" {
+		t.Errorf("Unsign() = %q, want %q", got, "sid-1")
+	}
+
+	// Sign always uses the first (newest) secret, so a cookie issued after
+	// rotation no longer verifies against the retired secret alone.
+	newSigned := rotatedSigner.Sign("sid-2")
+	if _, err := NewRotatingHMACSigner([]string{"old-secret"}).Unsign(newSigned); err == nil {
+		t.Error("Unsign() with only the retired secret unexpectedly succeeded")
+	}
+}
+
+func TestRotatingHMACSignerRejectsTamperedOrMalformed(t *testing.T) {
+	s := NewRotatingHMACSigner([]string{"secret"})
+	signed := s.Sign("sid")
+
+	values := []string{
+		signed[:len(signed)-1] + "x", // flipped last hash byte
+		"",
+		"s:missing-dot",
+		"s:.",
+	}
+	for _, v := range values {
+		if _, err := s.Unsign(v); err == nil {
+			t.Errorf("Unsign(%q) unexpectedly succeeded", v)
+		}
+	}
+}
+
+// TestManagerSealOpenSid checks that sealSid/openSid round-trip a sid
+// through Manager.encryptor, and that sealSid is a no-op when no
+// EncryptionKey was configured.
+func TestManagerSealOpenSid(t *testing.T) {
+	plain := &Manager{}
+	sealed, err := plain.sealSid("sid-1")
+	if err != nil {
+		t.Fatalf("sealSid() error = %v", err)
+	}
+	if sealed != "sid-1" {
+		t.Errorf("sealSid() with no encryptor = %q, want unchanged %q", sealed, "sid-1")
+	}
+
+	encrypted := &Manager{encryptor: NewAESGCMEncryptor("passphrase")}
+	sealed, err = encrypted.sealSid("sid-1")
+	if err != nil {
+		t.Fatalf("sealSid() error = %v", err)
+	}
+	if sealed == "sid-1" {
+		t.Error("sealSid() with an encryptor configured left the sid in plaintext")
+	}
+	got, err := encrypted.openSid(sealed)
+	if err != nil {
+		t.Fatalf("openSid() error = %v", err)
+	}
+	if got != "sid-1" {
+		t.Errorf("openSid(sealSid(sid)) = %q, want %q", got, "sid-1")
+	}
+}
+
+// fakeStore is a minimal in-memory Store/TimestampedStore used by the
+// tests below in place of a real provider.
+type fakeStore struct {
+	sid          string
+	created      time.Time
+	lastAccessed time.Time
+	data         map[interface{}]interface{}
+}
+
+func (s *fakeStore) Set(key, value interface{}) error     { s.data[key] = value; return nil }
+func (s *fakeStore) Get(key interface{}) interface{}      { return s.data[key] }
+func (s *fakeStore) Delete(key interface{}) error         { delete(s.data, key); return nil }
+func (s *fakeStore) SessionID() string                    { return s.sid }
+func (s *fakeStore) SessionRelease(w http.ResponseWriter) {}
+func (s *fakeStore) Flush() error                         { s.data = map[interface{}]interface{}{}; return nil }
+func (s *fakeStore) Created() time.Time                   { return s.created }
+func (s *fakeStore) LastAccessed() time.Time              { return s.lastAccessed }
+
+// fakeProvider is a minimal in-memory Provider used by the tests below.
+type fakeProvider struct {
+	mu       sync.Mutex
+	sessions map[string]*fakeStore
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{sessions: make(map[string]*fakeStore)}
+}
+
+func (p *fakeProvider) SessionInit(gclifetime int64, config string) error { return nil }
+
+func (p *fakeProvider) SessionRead(sid string) (Store, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.sessions[sid]
+	if !ok {
+		s = &fakeStore{sid: sid, data: make(map[interface{}]interface{})}
+		p.sessions[sid] = s
+	}
+	return s, nil
+}
+
+func (p *fakeProvider) SessionExist(sid string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.sessions[sid]
+	return ok
+}
+
+func (p *fakeProvider) SessionRegenerate(oldsid, sid string) (Store, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &fakeStore{sid: sid, created: time.Now(), data: make(map[interface{}]interface{})}
+	if old, ok := p.sessions[oldsid]; ok {
+		for k, v := range old.data {
+			s.data[k] = v
+		}
+		delete(p.sessions, oldsid)
+	}
+	p.sessions[sid] = s
+	return s, nil
+}
+
+func (p *fakeProvider) SessionDestroy(sid string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, sid)
+	return nil
+}
+
+func (p *fakeProvider) SessionAll() int { return len(p.sessions) }
+func (p *fakeProvider) SessionGC()      {}
+
+func TestCheckTimeouts(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name                  string
+		cfg                   ManagerConfig
+		created, lastAccessed time.Time
+		wantAction            timeoutAction
+		wantDestroyed         bool
+	}{
+		{
+			name:    "no timeouts configured, never destroyed or renewed",
+			cfg:     ManagerConfig{},
+			created: now.Add(-24 * time.Hour), lastAccessed: now.Add(-24 * time.Hour),
+			wantAction: sessionOK,
+		},
+		{
+			name:    "idle timeout fired",
+			cfg:     ManagerConfig{IdleTimeout: 10},
+			created: now.Add(-time.Hour), lastAccessed: now.Add(-time.Minute),
+			wantAction: sessionExpired, wantDestroyed: true,
+		},
+		{
+			name:    "absolute timeout fired despite recent access",
+			cfg:     ManagerConfig{AbsoluteTimeout: 10},
+			created: now.Add(-time.Minute), lastAccessed: now,
+			wantAction: sessionExpired, wantDestroyed: true,
+		},
+		{
+			name:    "renewal interval due, session left intact",
+			cfg:     ManagerConfig{RenewalInterval: 10},
+			created: now.Add(-time.Minute), lastAccessed: now,
+			wantAction: sessionRenew,
+		},
+		{
+			name:    "within all configured limits",
+			cfg:     ManagerConfig{IdleTimeout: 3600, AbsoluteTimeout: 3600, RenewalInterval: 3600},
+			created: now, lastAccessed: now,
+			wantAction: sessionOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newFakeProvider()
+			provider.sessions["sid"] = &fakeStore{
+				sid: "sid", created: tt.created, lastAccessed: tt.lastAccessed,
+				data: map[interface{}]interface{}{},
+			}
+			cfg := tt.cfg
+			m := &Manager{provider: provider, ctxProvider: asContextProvider(provider), config: &cfg}
+
+			action, err := m.checkTimeouts(context.Background(), "sid")
+			if err != nil {
+				t.Fatalf("checkTimeouts() error = %v", err)
+			}
+			if action != tt.wantAction {
+				t.Errorf("checkTimeouts() = %v, want %v", action, tt.wantAction)
+			}
+			if destroyed := !provider.SessionExist("sid"); destroyed != tt.wantDestroyed {
+				t.Errorf("session destroyed = %v, want %v", destroyed, tt.wantDestroyed)
+			}
+		})
+	}
+}
+
+// spyLocker records the sids Lock/unlock are called with, in order, so
+// tests can assert on locking order without depending on timing.
+type spyLocker struct {
+	mu       sync.Mutex
+	locked   []string
+	unlocked []string
+}
+
+func (l *spyLocker) Lock(ctx context.Context, sid string) (func(), error) {
+	l.mu.Lock()
+	l.locked = append(l.locked, sid)
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		l.unlocked = append(l.unlocked, sid)
+		l.mu.Unlock()
+	}, nil
+}
+
+// TestMarkAuthenticatedLocksOldSid checks that renewing a session id locks
+// the existing sid - the one whose SessionRegenerate/SessionDestroy calls
+// need serializing against concurrent requests - first, before the freshly
+// generated replacement id, and that the old sid's lock is the first one
+// released.
+func TestMarkAuthenticatedLocksOldSid(t *testing.T) {
+	provider := newFakeProvider()
+	provider.sessions["old-sid"] = &fakeStore{sid: "old-sid", data: map[interface{}]interface{}{}}
+	locker := &spyLocker{}
+	signer := NewRotatingHMACSigner(nil)
+	m := &Manager{
+		provider:    provider,
+		ctxProvider: asContextProvider(provider),
+		config:      &ManagerConfig{SessionIDLength: 16},
+		signer:      signer,
+		cookieName:  "gosessionid",
+		locker:      locker,
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "gosessionid", Value: url.QueryEscape(signer.Sign("old-sid"))})
+	w := httptest.NewRecorder()
+
+	if _, err := m.MarkAuthenticated(w, r); err != nil {
+		t.Fatalf("MarkAuthenticated() error = %v", err)
+	}
+
+	if len(locker.locked) == 0 || locker.locked[0] != "old-sid" {
+		t.Fatalf("first Lock() call = %v, want it to lock %q", locker.locked, "old-sid")
+	}
+	if len(locker.unlocked) == 0 || locker.unlocked[0] != "old-sid" {
+		t.Errorf("old sid was not the first to be unlocked; unlocked = %v", locker.unlocked)
+	}
+	if provider.SessionExist("old-sid") {
+		t.Error("old sid still exists in the provider after renewal")
+	}
+}
+
+// TestMutexLockerSerializesPerSid checks that concurrent Lock calls for the
+// same sid serialize, and that the locks map empties out once every
+// holder has released, so MutexLocker doesn't leak one *sync.Mutex per
+// sid for the life of the process.
+func TestMutexLockerSerializesPerSid(t *testing.T) {
+	l := NewMutexLocker()
+
+	const holders = 20
+	var active, sawConcurrent int32
+	var wg sync.WaitGroup
+	for i := 0; i < holders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := l.Lock(context.Background(), "shared-sid")
+			if err != nil {
+				t.Errorf("Lock() error = %v", err)
+				return
+			}
+			if atomic.AddInt32(&active, 1) != 1 {
+				atomic.StoreInt32(&sawConcurrent, 1)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&sawConcurrent) != 0 {
+		t.Error("MutexLocker allowed concurrent holders of the same sid")
+	}
+
+	l.mu.Lock()
+	remaining := len(l.locks)
+	l.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("locks map has %d entries after every holder released, want 0", remaining)
+	}
+}
+
+// TestMiddlewarePanicStillReleasesLock guards against the da17d66
+// regression: Middleware must release the session lock even when the
+// wrapped handler panics, or every later request for the same sid hangs
+// forever waiting on MutexLocker, which never expires on its own.
+func TestMiddlewarePanicStillReleasesLock(t *testing.T) {
+	provider := newFakeProvider()
+	provider.sessions["known-sid"] = &fakeStore{sid: "known-sid", data: map[interface{}]interface{}{}}
+	locker := NewMutexLocker()
+	signer := NewRotatingHMACSigner(nil)
+	m := &Manager{
+		provider:    provider,
+		ctxProvider: asContextProvider(provider),
+		config:      &ManagerConfig{SessionIDLength: 16},
+		signer:      signer,
+		cookieName:  "gosessionid",
+		locker:      locker,
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "gosessionid", Value: url.QueryEscape(signer.Sign("known-sid"))})
+	w := httptest.NewRecorder()
+
+	panicked := false
+	func() {
+		defer func() {
+			if recover() != nil {
+				panicked = true
+			}
+		}()
+		m.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			panic("boom")
+		})).ServeHTTP(w, r)
+	}()
+	if !panicked {
+		t.Fatal("expected the wrapped handler's panic to propagate out of Middleware")
+	}
+
+	// If the lock SessionStartContext took on "known-sid" wasn't released
+	// despite the panic, this Lock call blocks until ctx times out.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	unlock, err := locker.Lock(ctx, "known-sid")
+	if err != nil {
+		t.Fatalf("session lock was not released after the handler panicked: %v", err)
+	}
+	unlock()
+}
+
+func init() {
+	Register("faketestprovider", newFakeProvider())
+}
+
+// TestNewManagerCookieSecurity covers the validation NewManager applies to
+// CookiePrefix and SameSite, and that a valid CookiePrefix is applied to
+// cookieName so reads/writes transparently use the prefixed name.
+func TestNewManagerCookieSecurity(t *testing.T) {
+	tests := []struct {
+		name           string
+		mutate         func(cf *ManagerConfig)
+		wantErr        bool
+		wantCookieName string
+	}{
+		{
+			name:    "__Host- prefix requires Secure",
+			mutate:  func(cf *ManagerConfig) { cf.CookiePrefix = "host" },
+			wantErr: true,
+		},
+		{
+			name: "__Host- prefix forbids Domain",
+			mutate: func(cf *ManagerConfig) {
+				cf.CookiePrefix = "host"
+				cf.Secure = true
+				cf.Domain = "example.com"
+			},
+			wantErr: true,
+		},
+		{
+			name: "__Host- prefix applied to cookie name when valid",
+			mutate: func(cf *ManagerConfig) {
+				cf.CookiePrefix = "host"
+				cf.Secure = true
+			},
+			wantCookieName: "__Host-sid",
+		},
+		{
+			name: "CookiePrefix matches case-insensitively",
+			mutate: func(cf *ManagerConfig) {
+				cf.CookiePrefix = "Host"
+				cf.Secure = true
+			},
+			wantCookieName: "__Host-sid",
+		},
+		{
+			name:    "__Secure- prefix requires Secure",
+			mutate:  func(cf *ManagerConfig) { cf.CookiePrefix = "secure" },
+			wantErr: true,
+		},
+		{
+			name: "__Secure- prefix applied to cookie name when valid",
+			mutate: func(cf *ManagerConfig) {
+				cf.CookiePrefix = "secure"
+				cf.Secure = true
+			},
+			wantCookieName: "__Secure-sid",
+		},
+		{
+			name:    "unknown cookie prefix rejected",
+			mutate:  func(cf *ManagerConfig) { cf.CookiePrefix = "bogus" },
+			wantErr: true,
+		},
+		{
+			name:    "SameSite=none requires Secure",
+			mutate:  func(cf *ManagerConfig) { cf.SameSite = "none" },
+			wantErr: true,
+		},
+		{
+			name: "SameSite matches case-insensitively and is allowed with Secure",
+			mutate: func(cf *ManagerConfig) {
+				cf.SameSite = "None"
+				cf.Secure = true
+			},
+			wantCookieName: "sid",
+		},
+		{
+			name:    "unknown SameSite rejected",
+			mutate:  func(cf *ManagerConfig) { cf.SameSite = "bogus" },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf := &ManagerConfig{CookieName: "sid", Secret: "secret"}
+			tt.mutate(cf)
+
+			m, err := NewManager("faketestprovider", cf)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewManager() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewManager() error = %v", err)
+			}
+			if m.cookieName != tt.wantCookieName {
+				t.Errorf("cookieName = %q, want %q", m.cookieName, tt.wantCookieName)
+			}
+		})
+	}
+}